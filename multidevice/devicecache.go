@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RadicalApp/libsignal-protocol-go/keys/prekey"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+// defaultDeviceCacheTTL is how long a usync result is trusted before it's
+// considered cold and re-fetched, even without an invalidating
+// notification.
+const defaultDeviceCacheTTL = 10 * time.Minute
+
+// DeviceCacheMetrics holds hit/miss counters for a DeviceCache. Read the
+// fields with atomic.LoadInt64; operators running mdtest-like bots at
+// scale can poll these to tune TTLs.
+type DeviceCacheMetrics struct {
+	Hits   int64
+	Misses int64
+}
+
+type deviceCacheEntry struct {
+	devices []waBinary.FullJID
+	expires time.Time
+	dirty   bool
+}
+
+// DeviceCache holds recently-fetched usync device lists keyed by user
+// JID, so a send to the same chat doesn't round-trip to the server every
+// time. Entries expire after a TTL or can be invalidated early (e.g. by a
+// `<notification type="devices">` stanza).
+type DeviceCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*deviceCacheEntry
+	Metrics DeviceCacheMetrics
+}
+
+// NewDeviceCache creates a DeviceCache with the given TTL. A zero TTL
+// falls back to defaultDeviceCacheTTL.
+func NewDeviceCache(ttl time.Duration) *DeviceCache {
+	if ttl <= 0 {
+		ttl = defaultDeviceCacheTTL
+	}
+	return &DeviceCache{
+		ttl:     ttl,
+		entries: make(map[string]*deviceCacheEntry),
+	}
+}
+
+func (dc *DeviceCache) get(user string) ([]waBinary.FullJID, bool) {
+	dc.lock.Lock()
+	entry, ok := dc.entries[user]
+	dc.lock.Unlock()
+	if !ok || entry.dirty || time.Now().After(entry.expires) {
+		atomic.AddInt64(&dc.Metrics.Misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&dc.Metrics.Hits, 1)
+	return entry.devices, true
+}
+
+func (dc *DeviceCache) put(user string, devices []waBinary.FullJID) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.entries[user] = &deviceCacheEntry{
+		devices: devices,
+		expires: time.Now().Add(dc.ttl),
+	}
+}
+
+// invalidate marks user's cached device list as dirty, forcing the next
+// lookup to issue a fresh usync.
+func (dc *DeviceCache) invalidate(user string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if entry, ok := dc.entries[user]; ok {
+		entry.dirty = true
+	}
+}
+
+// cli.deviceCacheLock guards the lazy init of cli.deviceCache, the same
+// way groupDevicesLock and sentMessagesLock guard their lazy-initialized
+// fields in senderkey.go and retry.go: GetUSyncDevices/sendDM/sendGroup/
+// PrefetchDevices/InvalidateDeviceCache are all reachable concurrently on
+// the normal send hot path.
+func (cli *Client) initDeviceCache() {
+	cli.deviceCacheLock.Lock()
+	defer cli.deviceCacheLock.Unlock()
+	if cli.deviceCache == nil {
+		cli.deviceCache = NewDeviceCache(defaultDeviceCacheTTL)
+	}
+}
+
+// InvalidateDeviceCache forces the next GetUSyncDevices call for user to
+// hit the network instead of a cached entry. Call this when handling a
+// `<notification type="devices">` stanza for that user.
+func (cli *Client) InvalidateDeviceCache(user string) {
+	cli.initDeviceCache()
+	cli.deviceCache.invalidate(user)
+}
+
+// HandleDeviceListNotification parses a `<notification type="devices">`
+// stanza - sent by the server whenever a peer links or unlinks a device -
+// and invalidates that peer's cached device list, so the TTL isn't the
+// only thing standing between us and a stale send. Exported so the
+// caller's top-level stanza dispatch loop can route every incoming
+// `<notification type="devices">` node here, the same way it routes
+// `<receipt type="retry">` nodes to HandleRetryReceipt.
+func (cli *Client) HandleDeviceListNotification(node *waBinary.Node) error {
+	ag := node.AttrGetter()
+	notifType := ag.String("type")
+	from := ag.JID("from")
+	if !ag.OK() {
+		return fmt.Errorf("failed to parse device list notification attrs: %+v", ag.Errors)
+	}
+	if notifType != "devices" {
+		return fmt.Errorf("HandleDeviceListNotification called with unexpected type %q", notifType)
+	}
+	cli.InvalidateDeviceCache(from.User)
+	return nil
+}
+
+// PrefetchDevices warms the device cache for the given JIDs, so a
+// subsequent send to any of them becomes a cache lookup instead of a
+// usync round trip.
+func (cli *Client) PrefetchDevices(jids []waBinary.FullJID) error {
+	cli.initDeviceCache()
+	var cold []waBinary.FullJID
+	for _, jid := range jids {
+		if _, ok := cli.deviceCache.get(jid.User); !ok {
+			cold = append(cold, jid)
+		}
+	}
+	if len(cold) == 0 {
+		return nil
+	}
+	perUser, err := cli.getUSyncDevicesUncached(cold)
+	if err != nil {
+		return err
+	}
+	for user, userDevices := range perUser {
+		cli.deviceCache.put(user, userDevices)
+	}
+	return nil
+}
+
+// PreKeyBundleCache holds unused prekey bundles fetched for devices we
+// didn't end up needing on a given send (libsignal only consumes one
+// bundle per session init; if the server returns bundles for several of a
+// user's devices in one fetchPreKeys call, the extras used to be
+// discarded and re-fetched on the next send to that device).
+type PreKeyBundleCache struct {
+	lock    sync.Mutex
+	bundles map[waBinary.FullJID]*prekey.Bundle
+}
+
+// NewPreKeyBundleCache creates an empty PreKeyBundleCache.
+func NewPreKeyBundleCache() *PreKeyBundleCache {
+	return &PreKeyBundleCache{bundles: make(map[waBinary.FullJID]*prekey.Bundle)}
+}
+
+// Put stores a bundle that fetchPreKeys retrieved but wasn't consumed by
+// the current send.
+func (pc *PreKeyBundleCache) Put(jid waBinary.FullJID, bundle *prekey.Bundle) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.bundles[jid] = bundle
+}
+
+// Take removes and returns a cached bundle for jid, if one is available.
+func (pc *PreKeyBundleCache) Take(jid waBinary.FullJID) (*prekey.Bundle, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	bundle, ok := pc.bundles[jid]
+	if ok {
+		delete(pc.bundles, jid)
+	}
+	return bundle, ok
+}
+
+// cli.preKeyBundleCacheLock guards the lazy init of cli.preKeyBundleCache;
+// see initDeviceCache above for why this needs a lock.
+func (cli *Client) initPreKeyBundleCache() {
+	cli.preKeyBundleCacheLock.Lock()
+	defer cli.preKeyBundleCacheLock.Unlock()
+	if cli.preKeyBundleCache == nil {
+		cli.preKeyBundleCache = NewPreKeyBundleCache()
+	}
+}
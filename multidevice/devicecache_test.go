@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+func TestDeviceCacheGetPutRoundTrip(t *testing.T) {
+	dc := NewDeviceCache(time.Minute)
+	devices := []waBinary.FullJID{waBinary.NewADJID("111", 0, 0)}
+
+	if _, ok := dc.get("111"); ok {
+		t.Fatalf("expected a cold cache to miss")
+	}
+	dc.put("111", devices)
+	got, ok := dc.get("111")
+	if !ok {
+		t.Fatalf("expected a warm cache to hit")
+	}
+	if len(got) != 1 || got[0] != devices[0] {
+		t.Fatalf("got %v, want %v", got, devices)
+	}
+}
+
+func TestDeviceCacheExpiresAfterTTL(t *testing.T) {
+	dc := NewDeviceCache(time.Millisecond)
+	dc.put("111", []waBinary.FullJID{waBinary.NewADJID("111", 0, 0)})
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := dc.get("111"); ok {
+		t.Fatalf("expected entry to be expired after the TTL elapsed")
+	}
+}
+
+func TestDeviceCacheInvalidateForcesMiss(t *testing.T) {
+	dc := NewDeviceCache(time.Minute)
+	dc.put("111", []waBinary.FullJID{waBinary.NewADJID("111", 0, 0)})
+	dc.invalidate("111")
+
+	if _, ok := dc.get("111"); ok {
+		t.Fatalf("expected invalidated entry to miss")
+	}
+}
+
+func TestPreKeyBundleCachePutTake(t *testing.T) {
+	pc := NewPreKeyBundleCache()
+	jid := waBinary.NewADJID("111", 0, 0)
+
+	if _, ok := pc.Take(jid); ok {
+		t.Fatalf("expected an empty cache to miss")
+	}
+	pc.Put(jid, nil)
+	if _, ok := pc.Take(jid); !ok {
+		t.Fatalf("expected a stored bundle to be returned")
+	}
+	if _, ok := pc.Take(jid); ok {
+		t.Fatalf("expected Take to remove the entry")
+	}
+}
+
+// TestConcurrentDeviceCacheInit exercises the initDeviceCache/
+// initPreKeyBundleCache locking fix: GetUSyncDevices, PrefetchDevices,
+// and InvalidateDeviceCache are all reachable concurrently on the normal
+// send hot path and must not race allocating cli.deviceCache/
+// cli.preKeyBundleCache. Run with -race to catch a regression here.
+func TestConcurrentDeviceCacheInit(t *testing.T) {
+	cli := &Client{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			cli.initDeviceCache()
+		}()
+		go func() {
+			defer wg.Done()
+			cli.InvalidateDeviceCache("111")
+		}()
+		go func() {
+			defer wg.Done()
+			cli.initPreKeyBundleCache()
+		}()
+	}
+	wg.Wait()
+}
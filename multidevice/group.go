@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"fmt"
+
+	whatsapp "go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+// ParticipantChange is the parsed result of a single participant
+// add/remove/promote/demote requested through UpdateGroupParticipants.
+type ParticipantChange struct {
+	JID     waBinary.FullJID
+	Action  string // one of "add", "remove", "promote", "demote"
+	Success bool
+	Error   string
+}
+
+func participantJIDNodes(participants []waBinary.FullJID) []waBinary.Node {
+	nodes := make([]waBinary.Node, len(participants))
+	for i, jid := range participants {
+		nodes[i] = waBinary.Node{
+			Tag:   "participant",
+			Attrs: map[string]interface{}{"jid": jid},
+		}
+	}
+	return nodes
+}
+
+// CreateGroup creates a new group with the given subject and initial
+// participants (which do not need to include the local user).
+func (cli *Client) CreateGroup(subject string, participants []waBinary.FullJID) (*whatsapp.GroupInfo, error) {
+	key := GenerateMessageID()
+	res, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        waBinary.ServerJID,
+		Content: []waBinary.Node{{
+			Tag:     "create",
+			Attrs:   map[string]interface{}{"subject": subject, "key": key},
+			Content: participantJIDNodes(participants),
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send group create: %w", err)
+	}
+	groupNode, ok := res.GetOptionalChildByTag("group")
+	if !ok {
+		return nil, fmt.Errorf("group create response didn't contain group info")
+	}
+	return cli.parseGroupNode(&groupNode)
+}
+
+// LeaveGroup removes the local user from the given group.
+func (cli *Client) LeaveGroup(jid waBinary.FullJID) error {
+	_, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        waBinary.ServerJID,
+		Content: []waBinary.Node{{
+			Tag: "leave",
+			Content: []waBinary.Node{{
+				Tag:   "group",
+				Attrs: map[string]interface{}{"id": jid.User},
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send group leave: %w", err)
+	}
+	return nil
+}
+
+// UpdateGroupParticipants adds, removes, promotes, or demotes participants
+// in the given group. After a successful call, emits a
+// GroupParticipantsChange event so callers can react to the change.
+// sendGroup does not subscribe to this event; it notices a departed
+// device on its own by diffing the usync result against the last-known
+// device set (see diffGroupDevices in senderkey.go) and rotates the
+// sender key from there, so a removal is caught even if it happened
+// through some path other than this method.
+func (cli *Client) UpdateGroupParticipants(jid waBinary.FullJID, add, remove, promote, demote []waBinary.FullJID) ([]ParticipantChange, error) {
+	var changes []ParticipantChange
+	actions := []struct {
+		tag          string
+		action       string
+		participants []waBinary.FullJID
+	}{
+		{"add", "add", add},
+		{"remove", "remove", remove},
+		{"promote", "promote", promote},
+		{"demote", "demote", demote},
+	}
+	for _, a := range actions {
+		if len(a.participants) == 0 {
+			continue
+		}
+		res, err := cli.sendIQ(InfoQuery{
+			Namespace: "w:g2",
+			Type:      "set",
+			To:        jid,
+			Content: []waBinary.Node{{
+				Tag:     a.tag,
+				Content: participantJIDNodes(a.participants),
+			}},
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to send group %s: %w", a.action, err)
+		}
+		actionNode, ok := res.GetOptionalChildByTag(a.tag)
+		if !ok {
+			return changes, fmt.Errorf("group %s response didn't contain %s node", a.action, a.tag)
+		}
+		for _, participantNode := range actionNode.GetChildren() {
+			ag := participantNode.AttrGetter()
+			change := ParticipantChange{
+				JID:     ag.JID("jid"),
+				Action:  a.action,
+				Success: ag.OptionalString("error") == "",
+				Error:   ag.OptionalString("error"),
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	cli.dispatchEvent(&GroupParticipantsChange{
+		JID:     jid,
+		Add:     add,
+		Remove:  remove,
+		Promote: promote,
+		Demote:  demote,
+		Changes: changes,
+	})
+
+	return changes, nil
+}
+
+// GroupParticipantsChange is emitted whenever UpdateGroupParticipants
+// completes successfully, so application code can react to membership
+// changes. It is purely informational for sender key rotation purposes:
+// sendGroup has no subscriber on this event and instead rotates the key
+// by diffing the device list on the next send (diffGroupDevices in
+// senderkey.go), which also catches removals that happen outside of
+// UpdateGroupParticipants.
+type GroupParticipantsChange struct {
+	JID     waBinary.FullJID
+	Add     []waBinary.FullJID
+	Remove  []waBinary.FullJID
+	Promote []waBinary.FullJID
+	Demote  []waBinary.FullJID
+	Changes []ParticipantChange
+}
+
+// SetGroupSubject changes the group's subject/name.
+func (cli *Client) SetGroupSubject(jid waBinary.FullJID, subject string) error {
+	_, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        jid,
+		Content: []waBinary.Node{{
+			Tag:     "subject",
+			Content: []byte(subject),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send group subject update: %w", err)
+	}
+	return nil
+}
+
+// SetGroupDescription changes the group's description/topic.
+func (cli *Client) SetGroupDescription(jid waBinary.FullJID, description string) error {
+	_, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        jid,
+		Content: []waBinary.Node{{
+			Tag:   "description",
+			Attrs: map[string]interface{}{"id": GenerateMessageID()},
+			Content: []waBinary.Node{{
+				Tag:     "body",
+				Content: []byte(description),
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send group description update: %w", err)
+	}
+	return nil
+}
+
+// SetGroupAnnounce sets whether only admins can send messages to the group.
+func (cli *Client) SetGroupAnnounce(jid waBinary.FullJID, announce bool) error {
+	tag := "not_announcement"
+	if announce {
+		tag = "announcement"
+	}
+	_, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        jid,
+		Content:   []waBinary.Node{{Tag: tag}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send group announce update: %w", err)
+	}
+	return nil
+}
+
+// SetGroupLocked sets whether only admins can edit the group's metadata.
+func (cli *Client) SetGroupLocked(jid waBinary.FullJID, locked bool) error {
+	tag := "unlocked"
+	if locked {
+		tag = "locked"
+	}
+	_, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        jid,
+		Content:   []waBinary.Node{{Tag: tag}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send group locked update: %w", err)
+	}
+	return nil
+}
+
+// GetGroupInviteLink fetches the current invite link for the group.
+func (cli *Client) GetGroupInviteLink(jid waBinary.FullJID) (string, error) {
+	res, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "get",
+		To:        jid,
+		Content:   []waBinary.Node{{Tag: "invite"}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to request group invite link: %w", err)
+	}
+	return parseGroupInviteCode(res)
+}
+
+// RevokeGroupInviteLink revokes the group's current invite link and
+// returns the newly generated one.
+func (cli *Client) RevokeGroupInviteLink(jid waBinary.FullJID) (string, error) {
+	res, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        jid,
+		Content:   []waBinary.Node{{Tag: "invite"}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to revoke group invite link: %w", err)
+	}
+	return parseGroupInviteCode(res)
+}
+
+func parseGroupInviteCode(res *waBinary.Node) (string, error) {
+	inviteNode, ok := res.GetOptionalChildByTag("invite")
+	if !ok {
+		return "", fmt.Errorf("group invite response didn't contain invite node")
+	}
+	ag := inviteNode.AttrGetter()
+	code := ag.String("code")
+	if !ag.OK() {
+		return "", fmt.Errorf("group invite response didn't contain a code")
+	}
+	return fmt.Sprintf("https://chat.whatsapp.com/%s", code), nil
+}
+
+// JoinGroupWithInvite joins a group using an invite code previously
+// obtained from GetGroupInviteLink (the part after the last "/").
+func (cli *Client) JoinGroupWithInvite(code string) (*whatsapp.GroupInfo, error) {
+	res, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:g2",
+		Type:      "set",
+		To:        waBinary.ServerJID,
+		Content: []waBinary.Node{{
+			Tag:   "invite",
+			Attrs: map[string]interface{}{"code": code},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to join group with invite: %w", err)
+	}
+	groupNode, ok := res.GetOptionalChildByTag("group")
+	if !ok {
+		return nil, fmt.Errorf("group join response didn't contain group info")
+	}
+	return cli.parseGroupNode(&groupNode)
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"testing"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+func TestParticipantJIDNodes(t *testing.T) {
+	participants := []waBinary.FullJID{
+		waBinary.NewADJID("111", 0, 0),
+		waBinary.NewADJID("222", 0, 0),
+	}
+
+	nodes := participantJIDNodes(participants)
+	if len(nodes) != len(participants) {
+		t.Fatalf("got %d nodes, want %d", len(nodes), len(participants))
+	}
+	for i, node := range nodes {
+		if node.Tag != "participant" {
+			t.Fatalf("node %d has tag %q, want %q", i, node.Tag, "participant")
+		}
+		if node.Attrs["jid"] != participants[i] {
+			t.Fatalf("node %d jid attr = %v, want %v", i, node.Attrs["jid"], participants[i])
+		}
+	}
+}
+
+func TestParticipantJIDNodesEmpty(t *testing.T) {
+	nodes := participantJIDNodes(nil)
+	if len(nodes) != 0 {
+		t.Fatalf("expected no nodes for an empty participant list, got %d", len(nodes))
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// MediaType identifies which HKDF info string and upload bucket a piece
+// of media uses. WhatsApp derives independent keys per media kind even
+// though the derivation algorithm is shared.
+type MediaType string
+
+const (
+	MediaImage    MediaType = "image"
+	MediaVideo    MediaType = "video"
+	MediaAudio    MediaType = "audio"
+	MediaDocument MediaType = "document"
+	MediaSticker  MediaType = "sticker"
+)
+
+func (mt MediaType) hkdfInfo() string {
+	switch mt {
+	case MediaImage:
+		return "WhatsApp Image Keys"
+	case MediaVideo:
+		return "WhatsApp Video Keys"
+	case MediaAudio:
+		return "WhatsApp Audio Keys"
+	case MediaDocument:
+		return "WhatsApp Document Keys"
+	case MediaSticker:
+		return "WhatsApp Image Keys"
+	default:
+		panic(fmt.Sprintf("unknown media type %q", mt))
+	}
+}
+
+func (mt MediaType) uploadType() string {
+	switch mt {
+	case MediaSticker:
+		return "sticker"
+	default:
+		return string(mt)
+	}
+}
+
+// uploadedMedia is everything the caller needs to build the
+// Image/Video/Audio/Document/StickerMessage proto after a successful
+// upload.
+type uploadedMedia struct {
+	URL           string
+	DirectPath    string
+	MediaKey      []byte
+	FileSHA256    []byte
+	FileEncSHA256 []byte
+	FileLength    uint64
+}
+
+// uploadMedia encrypts plaintext with a freshly generated media key using
+// the per-type HKDF info string, uploads the ciphertext, and returns the
+// metadata needed to reference it from a message.
+func (cli *Client) uploadMedia(plaintext []byte, mediaType MediaType) (*uploadedMedia, error) {
+	mediaKey := make([]byte, 32)
+	if _, err := rand.Read(mediaKey); err != nil {
+		return nil, fmt.Errorf("failed to generate media key: %w", err)
+	}
+
+	iv, cipherKey, macKey, _, err := expandMediaKeys(mediaKey, mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := aesCBCEncrypt(plaintext, cipherKey, iv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt media: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	fileMAC := mac.Sum(nil)[:10]
+
+	fileEncSHA256 := sha256.Sum256(append(ciphertext, fileMAC...))
+	fileSHA256 := sha256.Sum256(plaintext)
+
+	uploadURL, directPath, err := cli.requestMediaUpload(mediaType, fileEncSHA256[:])
+	if err != nil {
+		return nil, err
+	}
+
+	body := append(ciphertext, fileMAC...)
+	if err = putMedia(uploadURL, body); err != nil {
+		return nil, err
+	}
+
+	return &uploadedMedia{
+		URL:           uploadURL,
+		DirectPath:    directPath,
+		MediaKey:      mediaKey,
+		FileSHA256:    fileSHA256[:],
+		FileEncSHA256: fileEncSHA256[:],
+		FileLength:    uint64(len(plaintext)),
+	}, nil
+}
+
+// expandMediaKeys derives iv||cipherKey||macKey||refKey from mediaKey via
+// HKDF-SHA256 using the media type's info string, per the WhatsApp media
+// encryption scheme.
+func expandMediaKeys(mediaKey []byte, mediaType MediaType) (iv, cipherKey, macKey, refKey []byte, err error) {
+	expanded := make([]byte, 112)
+	reader := hkdf.New(sha256.New, mediaKey, nil, []byte(mediaType.hkdfInfo()))
+	if _, err = io.ReadFull(reader, expanded); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to expand media keys: %w", err)
+	}
+	return expanded[:16], expanded[16:48], expanded[48:80], expanded[80:112], nil
+}
+
+// pkcs7Pad pads plaintext to a multiple of the AES block size, as
+// required for media (unlike the Signal message padding used on the
+// send/receive path in send.go and message_processor.go).
+func pkcs7Pad(plaintext []byte) []byte {
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	return append(plaintext, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+}
+
+func pkcs7Unpad(padded []byte) ([]byte, error) {
+	if len(padded) == 0 {
+		return nil, fmt.Errorf("can't unpad empty data")
+	}
+	padLen := int(padded[len(padded)-1])
+	if padLen == 0 || padLen > len(padded) {
+		return nil, fmt.Errorf("invalid pkcs7 padding")
+	}
+	return padded[:len(padded)-padLen], nil
+}
+
+func aesCBCEncrypt(plaintext, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padded := pkcs7Pad(plaintext)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return ciphertext, nil
+}
+
+func aesCBCDecrypt(ciphertext, key, iv []byte) ([]byte, error) {
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(padded, ciphertext)
+	return pkcs7Unpad(padded)
+}
+
+// requestMediaUpload asks the media_conn endpoint for an upload URL for a
+// blob identified by its (post-encryption) SHA-256 hash.
+func (cli *Client) requestMediaUpload(mediaType MediaType, fileEncSHA256 []byte) (uploadURL, directPath string, err error) {
+	res, err := cli.sendIQ(InfoQuery{
+		Namespace: "w:m",
+		Type:      "set",
+		To:        waBinary.ServerJID,
+		Content: []waBinary.Node{{
+			Tag: "media_conn",
+		}},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to request media_conn: %w", err)
+	}
+	mediaConn, ok := res.GetOptionalChildByTag("media_conn")
+	if !ok {
+		return "", "", fmt.Errorf("media_conn response didn't contain media_conn node")
+	}
+	auth := mediaConn.AttrGetter().String("auth")
+
+	var host string
+	for _, child := range mediaConn.GetChildren() {
+		if child.Tag == "host" {
+			host = child.AttrGetter().String("hostname")
+			break
+		}
+	}
+	if host == "" {
+		host = "mmg.whatsapp.net"
+	}
+
+	hash := base64.URLEncoding.EncodeToString(fileEncSHA256)
+	uploadURL = fmt.Sprintf("https://%s/mms/%s/%s?auth=%s", host, mediaType.uploadType(), hash, auth)
+	directPath = fmt.Sprintf("/mms/%s/%s", mediaType.uploadType(), hash)
+	return uploadURL, directPath, nil
+}
+
+func putMedia(uploadURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, uploadURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build media upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload media: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("media upload returned status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// SendImage uploads the given JPEG/PNG data and sends it as an
+// ImageMessage to the given chat.
+func (cli *Client) SendImage(to waBinary.FullJID, data io.Reader, mimeType, caption string) error {
+	plaintext, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read image data: %w", err)
+	}
+	uploaded, err := cli.uploadMedia(plaintext, MediaImage)
+	if err != nil {
+		return fmt.Errorf("failed to upload image: %w", err)
+	}
+	message := &waProto.Message{
+		ImageMessage: &waProto.ImageMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			Mimetype:      proto.String(mimeType),
+			Caption:       proto.String(caption),
+			MediaKey:      uploaded.MediaKey,
+			FileSha256:    uploaded.FileSHA256,
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+		},
+	}
+	return cli.SendMessage(to, "", message)
+}
+
+// SendVideo uploads the given video data and sends it as a VideoMessage
+// to the given chat.
+func (cli *Client) SendVideo(to waBinary.FullJID, data io.Reader, mimeType, caption string) error {
+	plaintext, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read video data: %w", err)
+	}
+	uploaded, err := cli.uploadMedia(plaintext, MediaVideo)
+	if err != nil {
+		return fmt.Errorf("failed to upload video: %w", err)
+	}
+	message := &waProto.Message{
+		VideoMessage: &waProto.VideoMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			Mimetype:      proto.String(mimeType),
+			Caption:       proto.String(caption),
+			MediaKey:      uploaded.MediaKey,
+			FileSha256:    uploaded.FileSHA256,
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+		},
+	}
+	return cli.SendMessage(to, "", message)
+}
+
+// SendAudio uploads the given audio data and sends it as an AudioMessage
+// to the given chat.
+func (cli *Client) SendAudio(to waBinary.FullJID, data io.Reader, mimeType string, ptt bool) error {
+	plaintext, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read audio data: %w", err)
+	}
+	uploaded, err := cli.uploadMedia(plaintext, MediaAudio)
+	if err != nil {
+		return fmt.Errorf("failed to upload audio: %w", err)
+	}
+	message := &waProto.Message{
+		AudioMessage: &waProto.AudioMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			Mimetype:      proto.String(mimeType),
+			Ptt:           proto.Bool(ptt),
+			MediaKey:      uploaded.MediaKey,
+			FileSha256:    uploaded.FileSHA256,
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+		},
+	}
+	return cli.SendMessage(to, "", message)
+}
+
+// SendDocument uploads the given file data and sends it as a
+// DocumentMessage to the given chat.
+func (cli *Client) SendDocument(to waBinary.FullJID, data io.Reader, mimeType, fileName string) error {
+	plaintext, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read document data: %w", err)
+	}
+	uploaded, err := cli.uploadMedia(plaintext, MediaDocument)
+	if err != nil {
+		return fmt.Errorf("failed to upload document: %w", err)
+	}
+	message := &waProto.Message{
+		DocumentMessage: &waProto.DocumentMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			Mimetype:      proto.String(mimeType),
+			FileName:      proto.String(fileName),
+			MediaKey:      uploaded.MediaKey,
+			FileSha256:    uploaded.FileSHA256,
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+		},
+	}
+	return cli.SendMessage(to, "", message)
+}
+
+// SendSticker uploads the given WebP data and sends it as a
+// StickerMessage to the given chat.
+func (cli *Client) SendSticker(to waBinary.FullJID, data io.Reader, mimeType string) error {
+	plaintext, err := ioutil.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read sticker data: %w", err)
+	}
+	uploaded, err := cli.uploadMedia(plaintext, MediaSticker)
+	if err != nil {
+		return fmt.Errorf("failed to upload sticker: %w", err)
+	}
+	message := &waProto.Message{
+		StickerMessage: &waProto.StickerMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			Mimetype:      proto.String(mimeType),
+			MediaKey:      uploaded.MediaKey,
+			FileSha256:    uploaded.FileSHA256,
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+		},
+	}
+	return cli.SendMessage(to, "", message)
+}
+
+// downloadableMedia is the subset of fields shared by every
+// Image/Video/Audio/Document/StickerMessage needed to fetch and decrypt
+// it.
+type downloadableMedia interface {
+	GetUrl() string
+	GetDirectPath() string
+	GetMediaKey() []byte
+	GetFileSha256() []byte
+	GetFileEncSha256() []byte
+	GetFileLength() uint64
+}
+
+// Download fetches and decrypts the media referenced by msg, verifying
+// both the ciphertext MAC and the plaintext SHA-256 before returning.
+func (cli *Client) Download(msg downloadableMedia) ([]byte, error) {
+	resp, err := http.Get(msg.GetUrl())
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media download returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media response: %w", err)
+	}
+	if len(body) < 10 {
+		return nil, fmt.Errorf("media response too short to contain a MAC")
+	}
+	ciphertext, fileMAC := body[:len(body)-10], body[len(body)-10:]
+
+	mediaType := mediaTypeOf(msg)
+	iv, cipherKey, macKey, _, err := expandMediaKeys(msg.GetMediaKey(), mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil)[:10], fileMAC) {
+		return nil, fmt.Errorf("media MAC verification failed")
+	}
+
+	plaintext, err := aesCBCDecrypt(ciphertext, cipherKey, iv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt media: %w", err)
+	}
+	plaintextSHA256 := sha256.Sum256(plaintext)
+	if !bytes.Equal(plaintextSHA256[:], msg.GetFileSha256()) {
+		return nil, fmt.Errorf("media SHA-256 verification failed")
+	}
+	return plaintext, nil
+}
+
+func mediaTypeOf(msg downloadableMedia) MediaType {
+	switch msg.(type) {
+	case *waProto.ImageMessage:
+		return MediaImage
+	case *waProto.VideoMessage:
+		return MediaVideo
+	case *waProto.AudioMessage:
+		return MediaAudio
+	case *waProto.DocumentMessage:
+		return MediaDocument
+	case *waProto.StickerMessage:
+		return MediaSticker
+	default:
+		return MediaDocument
+	}
+}
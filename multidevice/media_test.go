@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestExpandMediaKeysLengthsAndIndependence(t *testing.T) {
+	mediaKey := make([]byte, 32)
+	if _, err := rand.Read(mediaKey); err != nil {
+		t.Fatalf("failed to generate media key: %v", err)
+	}
+
+	iv, cipherKey, macKey, refKey, err := expandMediaKeys(mediaKey, MediaImage)
+	if err != nil {
+		t.Fatalf("expandMediaKeys failed: %v", err)
+	}
+	if len(iv) != 16 || len(cipherKey) != 32 || len(macKey) != 32 || len(refKey) != 32 {
+		t.Fatalf("unexpected key lengths: iv=%d cipherKey=%d macKey=%d refKey=%d", len(iv), len(cipherKey), len(macKey), len(refKey))
+	}
+
+	// Different media types derive independent keys from the same
+	// mediaKey, since each uses a different HKDF info string.
+	_, videoCipherKey, _, _, err := expandMediaKeys(mediaKey, MediaVideo)
+	if err != nil {
+		t.Fatalf("expandMediaKeys failed: %v", err)
+	}
+	if bytes.Equal(cipherKey, videoCipherKey) {
+		t.Fatalf("expected image and video cipher keys to differ")
+	}
+
+	// Sticker reuses the image info string, so its keys must match.
+	_, stickerCipherKey, _, _, err := expandMediaKeys(mediaKey, MediaSticker)
+	if err != nil {
+		t.Fatalf("expandMediaKeys failed: %v", err)
+	}
+	if !bytes.Equal(cipherKey, stickerCipherKey) {
+		t.Fatalf("expected image and sticker cipher keys to match")
+	}
+}
+
+func TestPKCS7PadUnpadRoundTrip(t *testing.T) {
+	cases := [][]byte{
+		[]byte(""),
+		[]byte("a"),
+		bytes.Repeat([]byte("x"), 15),
+		bytes.Repeat([]byte("x"), 16),
+		bytes.Repeat([]byte("x"), 33),
+	}
+	for _, plaintext := range cases {
+		padded := pkcs7Pad(append([]byte(nil), plaintext...))
+		if len(padded)%16 != 0 {
+			t.Fatalf("padded length %d is not a multiple of the block size", len(padded))
+		}
+		unpadded, err := pkcs7Unpad(padded)
+		if err != nil {
+			t.Fatalf("pkcs7Unpad failed: %v", err)
+		}
+		if !bytes.Equal(unpadded, plaintext) {
+			t.Fatalf("round trip mismatch: got %q, want %q", unpadded, plaintext)
+		}
+	}
+}
+
+func TestPKCS7UnpadRejectsInvalidPadding(t *testing.T) {
+	if _, err := pkcs7Unpad(nil); err == nil {
+		t.Fatalf("expected error for empty input")
+	}
+	if _, err := pkcs7Unpad([]byte{0}); err == nil {
+		t.Fatalf("expected error for zero pad length")
+	}
+	if _, err := pkcs7Unpad([]byte{1, 2, 3, 200}); err == nil {
+		t.Fatalf("expected error for pad length exceeding input")
+	}
+}
+
+func TestAESCBCEncryptDecryptRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	iv := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatalf("failed to generate iv: %v", err)
+	}
+
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+	ciphertext, err := aesCBCEncrypt(plaintext, key, iv)
+	if err != nil {
+		t.Fatalf("aesCBCEncrypt failed: %v", err)
+	}
+	decrypted, err := aesCBCDecrypt(ciphertext, key, iv)
+	if err != nil {
+		t.Fatalf("aesCBCDecrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("round trip mismatch: got %q, want %q", decrypted, plaintext)
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/RadicalApp/libsignal-protocol-go/groups"
+	"github.com/RadicalApp/libsignal-protocol-go/protocol"
+	"github.com/RadicalApp/libsignal-protocol-go/session"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// defaultDedupCacheSize is how many (from, id) pairs are kept in memory
+// before the least-recently-seen entry is evicted. A matching on-disk
+// store should be consulted first so a restart doesn't reprocess an
+// already-delivered message.
+const defaultDedupCacheSize = 2000
+
+// ErrNotPairedDevice is returned by ProcessIncoming when a message is
+// signed with our own identity but arrives from a device that isn't in
+// our companion (linked device) list. Upper layers can use this to decide
+// whether to drop the message or surface it as a warning.
+var ErrNotPairedDevice = errors.New("message from unrecognized companion device")
+
+// DecryptedMessage is the result of successfully decrypting one `<enc>`
+// child of an incoming `<message>` stanza.
+type DecryptedMessage struct {
+	Info    MessageInfo
+	Message *waProto.Message
+}
+
+// MessageInfo carries the envelope metadata for a DecryptedMessage.
+type MessageInfo struct {
+	ID       string
+	From     waBinary.FullJID
+	Chat     waBinary.FullJID
+	Timestamp int64
+	IsGroup  bool
+}
+
+// MessageProcessor owns both sides of the protocol: decoding `<message>`
+// stanzas, dispatching `<enc>` children to the right Signal/GroupCipher,
+// emitting a Message event, sending delivery/read receipts, and
+// de-duplicating by (from, id) on the inbound side; Send on the outbound
+// side, which just delegates to the same encryption helpers in send.go
+// that sendDM/sendGroup use. Grouped the same way status-protocol-go
+// groups its "message processor" so retry, ack, and dedup concerns all
+// live in one place. Session mutation is serialized per Signal address so
+// two ProcessIncoming calls for the same peer or group can't race on
+// ratchet state.
+type MessageProcessor struct {
+	cli *Client
+
+	dedupLock  sync.Mutex
+	dedupOrder []string
+	dedupSeen  map[string]struct{}
+	dedupStore DedupStore
+
+	sessionLocksLock sync.Mutex
+	sessionLocks     map[string]*sync.Mutex
+}
+
+// Send encrypts and delivers message the same way Client.SendMessage
+// does. It lives on MessageProcessor too so callers that already hold a
+// MessageProcessor for the inbound side don't need a separate reference
+// to the Client just to send.
+func (mp *MessageProcessor) Send(to waBinary.FullJID, id string, message *waProto.Message) error {
+	return mp.cli.SendMessage(to, id, message)
+}
+
+// lockSession returns the (lazily created) mutex guarding Signal session
+// state for addr, so pairwise decryption, group decryption, and sender
+// key distribution processing for the same address can't run
+// concurrently and corrupt the ratchet.
+func (mp *MessageProcessor) lockSession(addr string) *sync.Mutex {
+	mp.sessionLocksLock.Lock()
+	defer mp.sessionLocksLock.Unlock()
+	if mp.sessionLocks == nil {
+		mp.sessionLocks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := mp.sessionLocks[addr]
+	if !ok {
+		lock = &sync.Mutex{}
+		mp.sessionLocks[addr] = lock
+	}
+	return lock
+}
+
+// DedupStore is the on-disk half of the dedup cache. Implementations
+// should be safe for concurrent use.
+type DedupStore interface {
+	// HasSeen returns whether (from, id) was already recorded.
+	HasSeen(from waBinary.FullJID, id string) (bool, error)
+	// MarkSeen records (from, id) as processed.
+	MarkSeen(from waBinary.FullJID, id string) error
+}
+
+// NewMessageProcessor creates a MessageProcessor backed by the given
+// on-disk dedup store. Pass a nil store to rely solely on the in-memory
+// LRU (acceptable for short-lived processes, but a restart will reprocess
+// recent messages).
+func NewMessageProcessor(cli *Client, store DedupStore) *MessageProcessor {
+	return &MessageProcessor{
+		cli:        cli,
+		dedupSeen:  make(map[string]struct{}),
+		dedupStore: store,
+	}
+}
+
+// unpadMessage strips the PKCS#7-style padding that padMessage adds
+// before encryption (the last byte is the pad length).
+func unpadMessage(plaintext []byte) []byte {
+	if len(plaintext) == 0 {
+		return plaintext
+	}
+	padLength := int(plaintext[len(plaintext)-1])
+	if padLength == 0 || padLength > len(plaintext) {
+		return plaintext
+	}
+	return plaintext[:len(plaintext)-padLength]
+}
+
+func dedupKey(from waBinary.FullJID, id string) string {
+	return from.String() + "\x00" + id
+}
+
+// hasSeen checks (from, id) against the bounded in-memory cache and, if
+// configured, the on-disk store, without recording a new entry (an
+// in-memory hit only moves that entry to the back of the eviction order,
+// so the least-recently-seen entry is evicted first). Callers must
+// not treat a false result as a license to skip markSeen: a message isn't
+// "seen" until it has actually been delivered, or a failed decrypt would
+// be deduplicated away on every retry.
+func (mp *MessageProcessor) hasSeen(from waBinary.FullJID, id string) (bool, error) {
+	key := dedupKey(from, id)
+
+	mp.dedupLock.Lock()
+	_, inMemory := mp.dedupSeen[key]
+	if inMemory {
+		for i, k := range mp.dedupOrder {
+			if k == key {
+				mp.dedupOrder = append(mp.dedupOrder[:i], mp.dedupOrder[i+1:]...)
+				mp.dedupOrder = append(mp.dedupOrder, key)
+				break
+			}
+		}
+	}
+	mp.dedupLock.Unlock()
+	if inMemory {
+		return true, nil
+	}
+
+	if mp.dedupStore != nil {
+		onDisk, err := mp.dedupStore.HasSeen(from, id)
+		if err != nil {
+			return false, fmt.Errorf("failed to check dedup store for %s: %w", id, err)
+		}
+		if onDisk {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// markSeen records (from, id) as delivered in the in-memory cache and, if
+// configured, the on-disk store. This must only be called once at least
+// one `<enc>` child of the stanza decrypted successfully, otherwise a
+// message that fails to decrypt (no session yet, bad ciphertext) is
+// deduplicated away permanently and a resend - including one triggered by
+// our own retry-receipt mechanism - never reaches the application.
+func (mp *MessageProcessor) markSeen(from waBinary.FullJID, id string) error {
+	if mp.dedupStore != nil {
+		if err := mp.dedupStore.MarkSeen(from, id); err != nil {
+			return fmt.Errorf("failed to record dedup entry for %s: %w", id, err)
+		}
+	}
+
+	key := dedupKey(from, id)
+	mp.dedupLock.Lock()
+	mp.dedupSeen[key] = struct{}{}
+	mp.dedupOrder = append(mp.dedupOrder, key)
+	if len(mp.dedupOrder) > defaultDedupCacheSize {
+		oldest := mp.dedupOrder[0]
+		mp.dedupOrder = mp.dedupOrder[1:]
+		delete(mp.dedupSeen, oldest)
+	}
+	mp.dedupLock.Unlock()
+
+	return nil
+}
+
+// ProcessIncoming decodes a `<message>` stanza, decrypts every `<enc>`
+// child with the matching Signal or group cipher, de-duplicates against
+// already-processed (from, id) pairs, and sends the delivery receipt for
+// anything it successfully decrypted.
+func (mp *MessageProcessor) ProcessIncoming(node waBinary.Node) ([]DecryptedMessage, error) {
+	if node.Tag != "message" {
+		return nil, fmt.Errorf("ProcessIncoming called with non-message node %s", node.Tag)
+	}
+	ag := node.AttrGetter()
+	id := ag.String("id")
+	from := ag.JID("from")
+	chat := from
+	if participant, ok := ag.OptionalJID("participant"); ok {
+		chat = from
+		from = participant
+	}
+	timestamp := ag.Int64("t")
+	if !ag.OK() {
+		return nil, fmt.Errorf("failed to parse message attrs: %+v", ag.Errors)
+	}
+
+	alreadySeen, err := mp.hasSeen(chat, id)
+	if err != nil {
+		mp.cli.Log.Warnfln("Failed to check dedup cache for %s: %v", id, err)
+	} else if alreadySeen {
+		return nil, nil
+	}
+
+	isGroup := chat.Server == waBinary.GroupServer
+	if from.User == mp.cli.Session.ID.User && !mp.cli.isPairedDevice(from) {
+		return nil, ErrNotPairedDevice
+	}
+
+	var decrypted []DecryptedMessage
+	for _, child := range node.GetChildren() {
+		if child.Tag != "enc" {
+			continue
+		}
+		encAG := child.AttrGetter()
+		encType := encAG.String("type")
+		ciphertext, ok := child.Content.([]byte)
+		if !ok {
+			continue
+		}
+
+		var plaintext []byte
+		var decErr error
+		switch encType {
+		case "pkmsg", "msg":
+			plaintext, decErr = mp.decryptPairwise(from, ciphertext, encType)
+		case "skmsg":
+			plaintext, decErr = mp.decryptGroup(chat, from, ciphertext)
+		default:
+			decErr = fmt.Errorf("unsupported enc type %q", encType)
+		}
+		if decErr != nil {
+			mp.cli.Log.Warnfln("Failed to decrypt %s from %s: %v", id, from, decErr)
+			continue
+		}
+
+		plaintext = unpadMessage(plaintext)
+		var message waProto.Message
+		if err = proto.Unmarshal(plaintext, &message); err != nil {
+			mp.cli.Log.Warnfln("Failed to unmarshal decrypted message %s from %s: %v", id, from, err)
+			continue
+		}
+		if message.SenderKeyDistributionMessage != nil {
+			if err = mp.processSenderKeyDistributionMessage(chat, from, message.SenderKeyDistributionMessage); err != nil {
+				mp.cli.Log.Warnfln("Failed to process sender key distribution message from %s: %v", from, err)
+			}
+		}
+		decrypted = append(decrypted, DecryptedMessage{
+			Info: MessageInfo{
+				ID:        id,
+				From:      from,
+				Chat:      chat,
+				Timestamp: timestamp,
+				IsGroup:   isGroup,
+			},
+			Message: &message,
+		})
+	}
+
+	if len(decrypted) > 0 {
+		if err = mp.markSeen(chat, id); err != nil {
+			mp.cli.Log.Warnfln("Failed to record dedup entry for %s: %v", id, err)
+		}
+		if err = mp.sendReceipt(chat, from, id, "delivery"); err != nil {
+			mp.cli.Log.Warnfln("Failed to send delivery receipt for %s: %v", id, err)
+		}
+		for _, msg := range decrypted {
+			mp.cli.dispatchEvent(&Message{Info: msg.Info, Message: msg.Message})
+		}
+	}
+
+	return decrypted, nil
+}
+
+// Message is the event emitted for every successfully decrypted inbound
+// message.
+type Message struct {
+	Info    MessageInfo
+	Message *waProto.Message
+}
+
+func (mp *MessageProcessor) decryptPairwise(from waBinary.FullJID, ciphertext []byte, encType string) ([]byte, error) {
+	lock := mp.lockSession(from.String())
+	lock.Lock()
+	defer lock.Unlock()
+
+	builder := session.NewBuilderFromSignal(mp.cli.Session, from.SignalAddress(), pbSerializer)
+	cipher := session.NewCipher(builder, from.SignalAddress())
+	if encType == "pkmsg" {
+		msg, err := protocol.NewPreKeySignalMessageFromBytes(ciphertext, pbSerializer.PreKeySignalMessage, pbSerializer.SignalMessage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse prekey message: %w", err)
+		}
+		return cipher.DecryptMessage(msg)
+	}
+	msg, err := protocol.NewSignalMessageFromBytes(ciphertext, pbSerializer.SignalMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signal message: %w", err)
+	}
+	return cipher.Decrypt(msg)
+}
+
+func (mp *MessageProcessor) decryptGroup(chat, from waBinary.FullJID, ciphertext []byte) ([]byte, error) {
+	lock := mp.lockSession(chat.String() + "\x00" + from.String())
+	lock.Lock()
+	defer lock.Unlock()
+
+	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
+	builder := groups.NewGroupSessionBuilder(mp.cli.Session, pbSerializer)
+	cipher := groups.NewGroupCipher(builder, senderKeyName, mp.cli.Session)
+	msg, err := protocol.NewSenderKeyMessageFromBytes(ciphertext, pbSerializer.SenderKeyMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sender key message: %w", err)
+	}
+	return cipher.Decrypt(msg)
+}
+
+func (mp *MessageProcessor) processSenderKeyDistributionMessage(chat, from waBinary.FullJID, skdm *waProto.SenderKeyDistributionMessage) error {
+	lock := mp.lockSession(chat.String() + "\x00" + from.String())
+	lock.Lock()
+	defer lock.Unlock()
+
+	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
+	builder := groups.NewGroupSessionBuilder(mp.cli.Session, pbSerializer)
+	msg, err := protocol.NewSenderKeyDistributionMessageFromBytes(skdm.GetAxolotlSenderKeyDistributionMessage(), pbSerializer.SenderKeyDistributionMessage)
+	if err != nil {
+		return fmt.Errorf("failed to parse sender key distribution message: %w", err)
+	}
+	return builder.Process(senderKeyName, msg)
+}
+
+// isPairedDevice reports whether jid belongs to one of our own linked
+// devices (the companion list established during pairing).
+func (cli *Client) isPairedDevice(jid waBinary.FullJID) bool {
+	for _, companion := range cli.Session.CompanionDevices() {
+		if companion == jid {
+			return true
+		}
+	}
+	return false
+}
+
+// sendReceipt sends a delivery or read receipt for id, addressed to the
+// chat and (for groups) the specific participant that sent it.
+func (mp *MessageProcessor) sendReceipt(chat, participant waBinary.FullJID, id, receiptType string) error {
+	attrs := map[string]interface{}{
+		"id":   id,
+		"to":   chat,
+		"type": receiptType,
+	}
+	if chat.Server == waBinary.GroupServer {
+		attrs["participant"] = participant
+	}
+	return mp.cli.sendNode(waBinary.Node{
+		Tag:   "receipt",
+		Attrs: attrs,
+	})
+}
+
+// MarkRead sends a read receipt for id, addressed the same way as the
+// delivery receipt that ProcessIncoming sends.
+func (mp *MessageProcessor) MarkRead(chat, sender waBinary.FullJID, id string) error {
+	return mp.sendReceipt(chat, sender, id, "read")
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+func TestUnpadMessage(t *testing.T) {
+	plaintext := []byte("hello world")
+	padLen := 5
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+
+	if got := unpadMessage(padded); !bytes.Equal(got, plaintext) {
+		t.Fatalf("unpadMessage returned %q, want %q", got, plaintext)
+	}
+}
+
+func TestUnpadMessageInvalidPadIsReturnedVerbatim(t *testing.T) {
+	// unpadMessage intentionally tolerates a bad pad length instead of
+	// erroring, since a malformed plaintext will fail proto.Unmarshal
+	// right after anyway.
+	for _, in := range [][]byte{{}, {0}, {1, 2, 200}} {
+		if got := unpadMessage(in); !bytes.Equal(got, in) {
+			t.Fatalf("unpadMessage(%v) = %v, want unchanged", in, got)
+		}
+	}
+}
+
+type fakeDedupStore struct {
+	seen map[string]bool
+}
+
+func newFakeDedupStore() *fakeDedupStore {
+	return &fakeDedupStore{seen: make(map[string]bool)}
+}
+
+func (s *fakeDedupStore) HasSeen(from waBinary.FullJID, id string) (bool, error) {
+	return s.seen[dedupKey(from, id)], nil
+}
+
+func (s *fakeDedupStore) MarkSeen(from waBinary.FullJID, id string) error {
+	s.seen[dedupKey(from, id)] = true
+	return nil
+}
+
+func TestMarkSeenRequiredBeforeHasSeenReportsTrue(t *testing.T) {
+	mp := NewMessageProcessor(&Client{}, nil)
+	from := waBinary.NewADJID("111", 0, 0)
+
+	seen, err := mp.hasSeen(from, "msg1")
+	if err != nil || seen {
+		t.Fatalf("expected unseen message before markSeen, got seen=%v err=%v", seen, err)
+	}
+
+	// A message whose <enc> children all failed to decrypt never calls
+	// markSeen, so a retry of the same id must still look unseen.
+	seen, err = mp.hasSeen(from, "msg1")
+	if err != nil || seen {
+		t.Fatalf("expected a never-marked message to stay unseen across checks, got seen=%v err=%v", seen, err)
+	}
+
+	if err = mp.markSeen(from, "msg1"); err != nil {
+		t.Fatalf("markSeen failed: %v", err)
+	}
+	seen, err = mp.hasSeen(from, "msg1")
+	if err != nil || !seen {
+		t.Fatalf("expected message to be seen after markSeen, got seen=%v err=%v", seen, err)
+	}
+}
+
+func TestHasSeenConsultsOnDiskStore(t *testing.T) {
+	store := newFakeDedupStore()
+	mp := NewMessageProcessor(&Client{}, store)
+	from := waBinary.NewADJID("111", 0, 0)
+
+	if err := store.MarkSeen(from, "msg1"); err != nil {
+		t.Fatalf("failed to seed dedup store: %v", err)
+	}
+
+	seen, err := mp.hasSeen(from, "msg1")
+	if err != nil || !seen {
+		t.Fatalf("expected on-disk entry to be reported seen, got seen=%v err=%v", seen, err)
+	}
+}
+
+type erroringDedupStore struct{}
+
+func (erroringDedupStore) HasSeen(waBinary.FullJID, string) (bool, error) {
+	return false, errors.New("disk unavailable")
+}
+
+func (erroringDedupStore) MarkSeen(waBinary.FullJID, string) error {
+	return errors.New("disk unavailable")
+}
+
+func TestHasSeenPropagatesStoreError(t *testing.T) {
+	mp := NewMessageProcessor(&Client{}, erroringDedupStore{})
+	from := waBinary.NewADJID("111", 0, 0)
+
+	if _, err := mp.hasSeen(from, "msg1"); err == nil {
+		t.Fatalf("expected hasSeen to propagate the dedup store error")
+	}
+}
+
+func TestDedupCacheEvictsOldestEntry(t *testing.T) {
+	mp := NewMessageProcessor(&Client{}, nil)
+	from := waBinary.NewADJID("111", 0, 0)
+
+	for i := 0; i < defaultDedupCacheSize+1; i++ {
+		id := string(rune('a' + i%26))
+		if err := mp.markSeen(from, id+string(rune(i))); err != nil {
+			t.Fatalf("markSeen failed: %v", err)
+		}
+	}
+
+	if len(mp.dedupSeen) > defaultDedupCacheSize {
+		t.Fatalf("expected dedup cache to stay bounded at %d, got %d", defaultDedupCacheSize, len(mp.dedupSeen))
+	}
+	if _, ok := mp.dedupSeen[dedupKey(from, "a"+string(rune(0)))]; ok {
+		t.Fatalf("expected the oldest entry to be evicted")
+	}
+}
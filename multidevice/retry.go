@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/RadicalApp/libsignal-protocol-go/groups"
+	"github.com/RadicalApp/libsignal-protocol-go/keys/prekey"
+	"github.com/RadicalApp/libsignal-protocol-go/protocol"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// defaultSentMessageCacheSize is how many recently-sent plaintexts are kept
+// around so a retry receipt can be serviced without asking the caller to
+// resubmit the message.
+const defaultSentMessageCacheSize = 256
+
+// defaultMaxRetries is used when the caller hasn't installed a custom retry
+// policy via SetRetryPolicy.
+const defaultMaxRetries = 5
+
+// RetryBackoffFunc returns how long to wait before resending after the
+// given (1-indexed) retry attempt.
+type RetryBackoffFunc func(attempt int) time.Duration
+
+func defaultRetryBackoff(attempt int) time.Duration {
+	return time.Duration(attempt) * time.Second
+}
+
+type sentMessage struct {
+	to           waBinary.FullJID
+	plaintext    []byte
+	dsmPlaintext []byte
+	attempts     int
+}
+
+// SetRetryPolicy overrides how many times a message is re-encrypted and
+// resent in response to a retry receipt, and how long to wait between
+// attempts. Passing maxRetries <= 0 disables the retry subsystem entirely.
+func (cli *Client) SetRetryPolicy(maxRetries int, backoff RetryBackoffFunc) {
+	if backoff == nil {
+		backoff = defaultRetryBackoff
+	}
+	cli.sentMessagesLock.Lock()
+	defer cli.sentMessagesLock.Unlock()
+	// Initialize the cache here so a later initRetryCache doesn't replace
+	// this policy with the defaults.
+	if cli.sentMessages == nil {
+		cli.sentMessages = make(map[string]*sentMessage)
+	}
+	cli.retryMaxAttempts = maxRetries
+	cli.retryBackoff = backoff
+}
+
+func (cli *Client) initRetryCache() {
+	cli.sentMessagesLock.Lock()
+	defer cli.sentMessagesLock.Unlock()
+	if cli.sentMessages == nil {
+		cli.sentMessages = make(map[string]*sentMessage)
+		cli.retryMaxAttempts = defaultMaxRetries
+		cli.retryBackoff = defaultRetryBackoff
+	}
+}
+
+// rememberSentMessage stores the plaintext for id so a future retry receipt
+// can be serviced without the caller resubmitting the message.
+func (cli *Client) rememberSentMessage(to waBinary.FullJID, id string, plaintext, dsmPlaintext []byte) {
+	cli.initRetryCache()
+	cli.sentMessagesLock.Lock()
+	defer cli.sentMessagesLock.Unlock()
+	cli.sentMessages[id] = &sentMessage{to: to, plaintext: plaintext, dsmPlaintext: dsmPlaintext}
+	if len(cli.sentMessageOrder) >= defaultSentMessageCacheSize {
+		oldest := cli.sentMessageOrder[0]
+		cli.sentMessageOrder = cli.sentMessageOrder[1:]
+		delete(cli.sentMessages, oldest)
+	}
+	cli.sentMessageOrder = append(cli.sentMessageOrder, id)
+}
+
+// HandleRetryReceipt parses a `<receipt type="retry">` stanza and
+// re-delivers the message to the offending device after wiping its Signal
+// session and refetching a fresh prekey bundle. For a group message, only
+// the sender key distribution message is re-encrypted and sent to that
+// device; the group (skmsg) ciphertext itself is not re-sent. Exported so the caller's
+// top-level stanza dispatch loop can route every incoming
+// `<receipt type="retry">` node here, the same way it routes `<message>`
+// nodes to MessageProcessor.ProcessIncoming.
+func (cli *Client) HandleRetryReceipt(node *waBinary.Node) error {
+	ag := node.AttrGetter()
+	messageID := ag.String("id")
+	from := ag.JID("from")
+	if !ag.OK() {
+		return fmt.Errorf("failed to parse retry receipt attrs: %+v", ag.Errors)
+	}
+
+	if _, ok := node.GetOptionalChildByTag("retry"); !ok {
+		return fmt.Errorf("retry receipt for %s is missing <retry> node", messageID)
+	}
+	cli.initRetryCache()
+	cli.sentMessagesLock.Lock()
+	msg, ok := cli.sentMessages[messageID]
+	if !ok {
+		cli.sentMessagesLock.Unlock()
+		return fmt.Errorf("no cached plaintext for retried message %s, can't resend", messageID)
+	}
+	if cli.retryMaxAttempts <= 0 || msg.attempts >= cli.retryMaxAttempts {
+		attempts := msg.attempts
+		cli.sentMessagesLock.Unlock()
+		return fmt.Errorf("giving up on retried message %s after %d attempts", messageID, attempts)
+	}
+	msg.attempts++
+	attempt := msg.attempts
+	backoff := cli.retryBackoff
+	cli.sentMessagesLock.Unlock()
+
+	if backoff != nil {
+		// Back off based on our own attempt counter, not the peer-supplied
+		// <retry count="..."> attribute: a buggy or hostile peer could send
+		// an arbitrarily large count and block this (likely single-threaded)
+		// receipt-handling path for an arbitrary amount of time.
+		time.Sleep(backoff(attempt))
+	}
+
+	// The offending session is stale (wrong identity, missing sender key,
+	// etc.) so drop it and force a fresh prekey-based handshake.
+	cli.Session.DeleteSession(from.SignalAddress())
+
+	bundles, err := cli.fetchPreKeys([]waBinary.FullJID{from})
+	if err != nil {
+		return fmt.Errorf("failed to fetch prekey bundle for retry of %s to %s: %w", messageID, from, err)
+	}
+	resp, ok := bundles[from]
+	if !ok || resp.err != nil {
+		return fmt.Errorf("no prekey bundle available for retry of %s to %s", messageID, from)
+	}
+
+	plaintext := msg.plaintext
+	if from.User == cli.Session.ID.User && msg.dsmPlaintext != nil {
+		plaintext = msg.dsmPlaintext
+	}
+
+	var participantNode *waBinary.Node
+	var includeIdentity bool
+	if msg.to.Server == waBinary.GroupServer {
+		participantNode, includeIdentity, err = cli.reEncryptGroupMessageForDevice(msg.to, from, resp.bundle)
+	} else {
+		var encrypted *waBinary.Node
+		var isPreKey bool
+		encrypted, isPreKey, err = cli.encryptMessageForDevice(plaintext, from, resp.bundle)
+		participantNode, includeIdentity = encrypted, isPreKey
+	}
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt retried message %s for %s: %w", messageID, from, err)
+	}
+
+	retryTag := msg.to.Server == waBinary.GroupServer
+	node2 := waBinary.Node{
+		Tag: "message",
+		Attrs: map[string]interface{}{
+			"id":   messageID,
+			"type": "text",
+			"to":   msg.to,
+		},
+		Content: []waBinary.Node{{
+			Tag:     "participants",
+			Content: []waBinary.Node{*participantNode},
+		}},
+	}
+	if retryTag {
+		node2.Attrs["participant"] = from
+	}
+	if includeIdentity {
+		if err = cli.appendDeviceIdentityNode(&node2); err != nil {
+			return err
+		}
+	}
+	return cli.sendNode(node2)
+}
+
+// reEncryptGroupMessageForDevice rebuilds and re-sends the sender key
+// distribution message for a single device, instead of the whole
+// participant list, so a retry receipt from one member doesn't require
+// re-sending to everyone.
+func (cli *Client) reEncryptGroupMessageForDevice(to, device waBinary.FullJID, bundle *prekey.Bundle) (*waBinary.Node, bool, error) {
+	builder := groups.NewGroupSessionBuilder(cli.Session, pbSerializer)
+	senderKeyName := protocol.NewSenderKeyName(to.String(), cli.Session.ID.SignalAddress())
+	signalSKDMessage, err := builder.Create(senderKeyName)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create sender key distribution message for retry to %s: %w", device, err)
+	}
+	skdMessage := &waProto.Message{
+		SenderKeyDistributionMessage: &waProto.SenderKeyDistributionMessage{
+			GroupId:                             proto.String(to.String()),
+			AxolotlSenderKeyDistributionMessage: signalSKDMessage.Serialize(),
+		},
+	}
+	skdPlaintext, err := proto.Marshal(skdMessage)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal sender key distribution message: %w", err)
+	}
+	return cli.encryptMessageForDevice(skdPlaintext, device, bundle)
+}
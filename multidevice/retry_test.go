@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+func TestDefaultRetryBackoffIsLinearInAttempt(t *testing.T) {
+	if got, want := defaultRetryBackoff(1), time.Second; got != want {
+		t.Fatalf("defaultRetryBackoff(1) = %v, want %v", got, want)
+	}
+	if got, want := defaultRetryBackoff(3), 3*time.Second; got != want {
+		t.Fatalf("defaultRetryBackoff(3) = %v, want %v", got, want)
+	}
+}
+
+func TestInitRetryCacheAppliesDefaultsOnce(t *testing.T) {
+	cli := &Client{}
+	cli.initRetryCache()
+	if cli.retryMaxAttempts != defaultMaxRetries {
+		t.Fatalf("retryMaxAttempts = %d, want %d", cli.retryMaxAttempts, defaultMaxRetries)
+	}
+	if cli.retryBackoff == nil {
+		t.Fatalf("retryBackoff should be populated with a default")
+	}
+
+	// A second call must not clobber a policy set in between.
+	cli.SetRetryPolicy(1, nil)
+	cli.initRetryCache()
+	if cli.retryMaxAttempts != 1 {
+		t.Fatalf("initRetryCache overwrote an already-set retry policy: got %d, want 1", cli.retryMaxAttempts)
+	}
+}
+
+func TestSetRetryPolicyFallsBackToDefaultBackoff(t *testing.T) {
+	cli := &Client{}
+	cli.SetRetryPolicy(2, nil)
+	if cli.retryMaxAttempts != 2 {
+		t.Fatalf("retryMaxAttempts = %d, want 2", cli.retryMaxAttempts)
+	}
+	if cli.retryBackoff == nil {
+		t.Fatalf("a nil backoff should be replaced with defaultRetryBackoff")
+	}
+}
+
+func TestRememberSentMessageEvictsOldestBeyondCacheSize(t *testing.T) {
+	cli := &Client{}
+	to := waBinary.NewADJID("111", 0, 0)
+
+	for i := 0; i < defaultSentMessageCacheSize+1; i++ {
+		id := GenerateMessageID()
+		cli.rememberSentMessage(to, id, []byte("plaintext"), nil)
+	}
+
+	if len(cli.sentMessages) != defaultSentMessageCacheSize {
+		t.Fatalf("expected sent message cache to stay bounded at %d, got %d", defaultSentMessageCacheSize, len(cli.sentMessages))
+	}
+	if len(cli.sentMessageOrder) != defaultSentMessageCacheSize {
+		t.Fatalf("expected sent message order to stay bounded at %d, got %d", defaultSentMessageCacheSize, len(cli.sentMessageOrder))
+	}
+}
+
+// TestConcurrentRetryCacheInitAndPolicyUpdate exercises the lazy-init and
+// SetRetryPolicy locking fixes: concurrent sends (rememberSentMessage),
+// policy updates, and initRetryCache calls on the same Client must not
+// race on sentMessages/retryMaxAttempts/retryBackoff. Run with -race to
+// make a regression here fail loudly instead of silently.
+func TestConcurrentRetryCacheInitAndPolicyUpdate(t *testing.T) {
+	cli := &Client{}
+	to := waBinary.NewADJID("111", 0, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			cli.rememberSentMessage(to, GenerateMessageID(), []byte("plaintext"), nil)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			cli.SetRetryPolicy(i+1, nil)
+		}(i)
+	}
+	wg.Wait()
+}
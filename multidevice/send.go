@@ -70,22 +70,36 @@ func (cli *Client) sendGroup(to waBinary.FullJID, id string, message *waProto.Me
 	if err != nil {
 		return err
 	}
+	cli.rememberSentMessage(to, id, plaintext, nil)
 
-	builder := groups.NewGroupSessionBuilder(cli.Session, pbSerializer)
-	senderKeyName := protocol.NewSenderKeyName(to.String(), cli.Session.ID.SignalAddress())
-	signalSKDMessage, err := builder.Create(senderKeyName)
+	participants := make([]waBinary.FullJID, len(groupInfo.Participants))
+	participantsStrings := make([]string, len(groupInfo.Participants))
+	for i, part := range groupInfo.Participants {
+		participants[i] = part.FullJID
+		participantsStrings[i] = part.FullJID.String()
+	}
+
+	allDevices, err := cli.GetUSyncDevices(participants, false)
 	if err != nil {
-		return fmt.Errorf("failed to create sender key distribution message to send %s to %s: %w", id, to, err)
+		return fmt.Errorf("failed to get device list: %w", err)
 	}
-	skdMessage := &waProto.Message{
-		SenderKeyDistributionMessage: &waProto.SenderKeyDistributionMessage{
-			GroupId:                             proto.String(to.String()),
-			AxolotlSenderKeyDistributionMessage: signalSKDMessage.Serialize(),
-		},
+
+	// The underlying libsignal group session persists until explicitly
+	// deleted, so a shrunk device set (a participant removed, or a device
+	// dropped) must force a brand new sender key, not just reuse the old
+	// one that a departed device can still decrypt.
+	addedDevices, shrunk := cli.diffGroupDevices(to, allDevices)
+	senderKeyName := protocol.NewSenderKeyName(to.String(), cli.Session.ID.SignalAddress())
+	if shrunk {
+		if err = cli.Session.DeleteSenderKey(senderKeyName); err != nil {
+			return fmt.Errorf("failed to delete stale sender key for %s: %w", to, err)
+		}
 	}
-	skdPlaintext, err := proto.Marshal(skdMessage)
+
+	builder := groups.NewGroupSessionBuilder(cli.Session, pbSerializer)
+	signalSKDMessage, err := builder.Create(senderKeyName)
 	if err != nil {
-		return fmt.Errorf("failed to marshal sender key distribution message to send %s to %s: %w", id, to, err)
+		return fmt.Errorf("failed to create sender key distribution message to send %s to %s: %w", id, to, err)
 	}
 
 	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Session)
@@ -95,18 +109,27 @@ func (cli *Client) sendGroup(to waBinary.FullJID, id string, message *waProto.Me
 	}
 	ciphertext := encrypted.SignedSerialize()
 
-	participants := make([]waBinary.FullJID, len(groupInfo.Participants))
-	participantsStrings := make([]string, len(groupInfo.Participants))
-	for i, part := range groupInfo.Participants {
-		participants[i] = part.FullJID
-		participantsStrings[i] = part.FullJID.String()
-	}
-
-	allDevices, err := cli.GetUSyncDevices(participants, false)
-	if err != nil {
-		return fmt.Errorf("failed to get device list: %w", err)
+	// When the device set only grew, the SKDM only needs to reach the new
+	// devices; everyone else already has the unchanged sender key.
+	skdmTargets := addedDevices
+	if shrunk {
+		skdmTargets = allDevices
+	}
+	var participantNodes []waBinary.Node
+	var includeIdentity bool
+	if len(skdmTargets) > 0 {
+		skdMessage := &waProto.Message{
+			SenderKeyDistributionMessage: &waProto.SenderKeyDistributionMessage{
+				GroupId:                             proto.String(to.String()),
+				AxolotlSenderKeyDistributionMessage: signalSKDMessage.Serialize(),
+			},
+		}
+		skdPlaintext, err := proto.Marshal(skdMessage)
+		if err != nil {
+			return fmt.Errorf("failed to marshal sender key distribution message to send %s to %s: %w", id, to, err)
+		}
+		participantNodes, includeIdentity = cli.encryptMessageForDevices(skdmTargets, id, skdPlaintext, nil)
 	}
-	participantNodes, includeIdentity := cli.encryptMessageForDevices(allDevices, id, skdPlaintext, nil)
 
 	node := waBinary.Node{
 		Tag: "message",
@@ -139,6 +162,7 @@ func (cli *Client) sendDM(to waBinary.FullJID, id string, message *waProto.Messa
 	if err != nil {
 		return err
 	}
+	cli.rememberSentMessage(to, id, messagePlaintext, deviceSentMessagePlaintext)
 
 	allDevices, err := cli.GetUSyncDevices([]waBinary.FullJID{to, *cli.Session.ID}, false)
 	if err != nil {
@@ -216,6 +240,10 @@ func (cli *Client) GetGroupInfo(jid waBinary.FullJID) (*whatsapp.GroupInfo, erro
 		return nil, fmt.Errorf("group info request didn't return group info")
 	}
 
+	return cli.parseGroupNode(&groupNode)
+}
+
+func (cli *Client) parseGroupNode(groupNode *waBinary.Node) (*whatsapp.GroupInfo, error) {
 	var group whatsapp.GroupInfo
 	ag := groupNode.AttrGetter()
 
@@ -251,7 +279,7 @@ func (cli *Client) GetGroupInfo(jid waBinary.FullJID) (*whatsapp.GroupInfo, erro
 		case "locked":
 			group.Locked = true
 		default:
-			cli.Log.Debugfln("Unknown element in group node %s: %s", jid.String(), child.XMLString())
+			cli.Log.Debugfln("Unknown element in group node %s: %s", group.JID, child.XMLString())
 		}
 		if !childAG.OK() {
 			cli.Log.Warnfln("Possibly failed to parse %s element in group node: %+v", child.Tag, childAG.Errors)
@@ -261,7 +289,55 @@ func (cli *Client) GetGroupInfo(jid waBinary.FullJID) (*whatsapp.GroupInfo, erro
 	return &group, nil
 }
 
+// GetUSyncDevices resolves the full device list for jids. Warm entries in
+// the device cache are returned without a network round trip; only
+// cold or invalidated users trigger a usync query.
 func (cli *Client) GetUSyncDevices(jids []waBinary.FullJID, ignorePrimary bool) ([]waBinary.FullJID, error) {
+	cli.initDeviceCache()
+
+	var devices []waBinary.FullJID
+	var cold []waBinary.FullJID
+	seenUsers := make(map[string]bool, len(jids))
+	for _, jid := range jids {
+		if seenUsers[jid.User] {
+			continue
+		}
+		seenUsers[jid.User] = true
+		if cached, ok := cli.deviceCache.get(jid.User); ok {
+			devices = append(devices, filterUSyncDevices(cached, cli.Session.ID, ignorePrimary)...)
+		} else {
+			cold = append(cold, jid)
+		}
+	}
+	if len(cold) == 0 {
+		return devices, nil
+	}
+
+	perUser, err := cli.getUSyncDevicesUncached(cold)
+	if err != nil {
+		return nil, err
+	}
+	for user, userDevices := range perUser {
+		cli.deviceCache.put(user, userDevices)
+		devices = append(devices, filterUSyncDevices(userDevices, cli.Session.ID, ignorePrimary)...)
+	}
+
+	return devices, nil
+}
+
+func filterUSyncDevices(devices []waBinary.FullJID, self *waBinary.FullJID, ignorePrimary bool) []waBinary.FullJID {
+	filtered := make([]waBinary.FullJID, 0, len(devices))
+	for _, device := range devices {
+		if (device.Device > 0 || !ignorePrimary) && device != *self {
+			filtered = append(filtered, device)
+		}
+	}
+	return filtered
+}
+
+// getUSyncDevicesUncached fetches the raw (unfiltered) device list for
+// jids directly from the server, grouped by user JID.
+func (cli *Client) getUSyncDevicesUncached(jids []waBinary.FullJID) (map[string][]waBinary.FullJID, error) {
 	userList := make([]waBinary.Node, len(jids))
 	for i, jid := range jids {
 		userList[i].Tag = "user"
@@ -303,7 +379,7 @@ func (cli *Client) GetUSyncDevices(jids []waBinary.FullJID, ignorePrimary bool)
 		return nil, fmt.Errorf("missing list inside usync tag")
 	}
 
-	var devices []waBinary.FullJID
+	devices := make(map[string][]waBinary.FullJID, len(jids))
 	for _, user := range list.GetChildren() {
 		jid, jidOK := user.Attrs["jid"].(waBinary.FullJID)
 		if user.Tag != "user" || !jidOK {
@@ -320,9 +396,7 @@ func (cli *Client) GetUSyncDevices(jids []waBinary.FullJID, ignorePrimary bool)
 				continue
 			}
 			deviceJID := waBinary.NewADJID(jid.User, 0, byte(deviceID))
-			if (deviceJID.Device > 0 || !ignorePrimary) && deviceJID != *cli.Session.ID {
-				devices = append(devices, deviceJID)
-			}
+			devices[jid.User] = append(devices[jid.User], deviceJID)
 		}
 	}
 
@@ -364,30 +438,63 @@ func (cli *Client) encryptMessageForDevices(allDevices []waBinary.FullJID, id st
 		}
 	}
 	if len(retryDevices) > 0 {
-		bundles, err := cli.fetchPreKeys(retryDevices)
-		if err != nil {
-			cli.Log.Warnln("Failed to fetch prekeys for", retryDevices, "to retry encryption:", err)
-		} else {
-			for _, jid := range retryDevices {
-				resp := bundles[jid]
-				if resp.err != nil {
-					cli.Log.Warnfln("Failed to fetch prekey for %s: %v", jid, resp.err)
-					continue
-				}
-				plaintext := msgPlaintext
-				if jid.User == cli.Session.ID.User && dsmPlaintext != nil {
-					plaintext = dsmPlaintext
-				}
-				encrypted, isPreKey, err := cli.encryptMessageForDevice(plaintext, jid, resp.bundle)
-				if err != nil {
-					cli.Log.Warnfln("Failed to encrypt %s for %s (retry): %v", id, jid, err)
-					continue
-				}
-				participantNodes = append(participantNodes, *encrypted)
-				if isPreKey {
-					includeIdentity = true
+		cli.initPreKeyBundleCache()
+
+		var toFetch []waBinary.FullJID
+		cachedBundles := make(map[waBinary.FullJID]*prekey.Bundle, len(retryDevices))
+		for _, jid := range retryDevices {
+			if bundle, ok := cli.preKeyBundleCache.Take(jid); ok {
+				cachedBundles[jid] = bundle
+			} else {
+				toFetch = append(toFetch, jid)
+			}
+		}
+
+		fetched, err := cli.fetchPreKeys(toFetch)
+		if len(toFetch) > 0 && err != nil {
+			cli.Log.Warnln("Failed to fetch prekeys for", toFetch, "to retry encryption:", err)
+		}
+		for jid, resp := range fetched {
+			if resp.err != nil || cachedBundles[jid] != nil {
+				continue
+			}
+			isRequested := false
+			for _, requested := range toFetch {
+				if requested == jid {
+					isRequested = true
+					break
 				}
 			}
+			if isRequested {
+				cachedBundles[jid] = resp.bundle
+			} else {
+				// The server returned a bundle for a device we didn't
+				// ask about this round (e.g. a sibling device of the
+				// same user); keep it for the next send instead of
+				// discarding it.
+				cli.preKeyBundleCache.Put(jid, resp.bundle)
+			}
+		}
+
+		for _, jid := range retryDevices {
+			bundle, ok := cachedBundles[jid]
+			if !ok {
+				cli.Log.Warnfln("Failed to fetch prekey for %s", jid)
+				continue
+			}
+			plaintext := msgPlaintext
+			if jid.User == cli.Session.ID.User && dsmPlaintext != nil {
+				plaintext = dsmPlaintext
+			}
+			encrypted, isPreKey, err := cli.encryptMessageForDevice(plaintext, jid, bundle)
+			if err != nil {
+				cli.Log.Warnfln("Failed to encrypt %s for %s (retry): %v", id, jid, err)
+				continue
+			}
+			participantNodes = append(participantNodes, *encrypted)
+			if isPreKey {
+				includeIdentity = true
+			}
 		}
 	}
 	return participantNodes, includeIdentity
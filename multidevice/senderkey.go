@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"fmt"
+
+	"github.com/RadicalApp/libsignal-protocol-go/protocol"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+// groupDeviceSet is the last-known set of devices a group's sender key was
+// distributed to, keyed by group JID string. It's compared against the
+// fresh usync result on every send so a shrinking device set (participant
+// removed, or a device deleted) triggers a sender key rotation instead of
+// silently letting the departed device keep decrypting future messages.
+type groupDeviceSet map[string]map[waBinary.FullJID]struct{}
+
+// cli.groupDevicesLock guards cli.groupDevices. sendGroup sits on the hot
+// send path and is routinely called concurrently (sends to different
+// groups, or a retry firing while a new send starts), so every read and
+// write of the map must go through that lock instead of a bare nil-check,
+// the same way sentMessagesLock guards the retry cache in retry.go.
+func (cli *Client) initGroupDeviceTracking() {
+	cli.groupDevicesLock.Lock()
+	defer cli.groupDevicesLock.Unlock()
+	if cli.groupDevices == nil {
+		cli.groupDevices = make(groupDeviceSet)
+	}
+}
+
+// diffGroupDevices compares the freshly-fetched device list for a group
+// against the last-known set, and returns the devices that need a fresh
+// sender key distribution message plus whether any device left the group
+// (which requires a full key rotation rather than an incremental SKDM).
+// On the first call for a group, every device is reported as added.
+func (cli *Client) diffGroupDevices(jid waBinary.FullJID, current []waBinary.FullJID) (added []waBinary.FullJID, shrunk bool) {
+	cli.initGroupDeviceTracking()
+	key := jid.String()
+
+	cli.groupDevicesLock.Lock()
+	defer cli.groupDevicesLock.Unlock()
+
+	previous, hadPrevious := cli.groupDevices[key]
+
+	currentSet := make(map[waBinary.FullJID]struct{}, len(current))
+	for _, jid := range current {
+		currentSet[jid] = struct{}{}
+		if !hadPrevious {
+			added = append(added, jid)
+			continue
+		}
+		if _, ok := previous[jid]; !ok {
+			added = append(added, jid)
+		}
+	}
+	if hadPrevious {
+		for jid := range previous {
+			if _, ok := currentSet[jid]; !ok {
+				shrunk = true
+				break
+			}
+		}
+	}
+
+	cli.groupDevices[key] = currentSet
+	return
+}
+
+// ForceGroupSenderKeyRotation deletes the group's current sender key
+// session so the next sendGroup call generates a fresh one and
+// redistributes it to every device. Callers that just completed an admin
+// action (e.g. a participant removal outside of UpdateGroupParticipants)
+// can use this to force forward secrecy immediately instead of waiting
+// for the next device-list diff to notice the change.
+func (cli *Client) ForceGroupSenderKeyRotation(jid waBinary.FullJID) error {
+	senderKeyName := protocol.NewSenderKeyName(jid.String(), cli.Session.ID.SignalAddress())
+	err := cli.Session.DeleteSenderKey(senderKeyName)
+	if err != nil {
+		return fmt.Errorf("failed to delete sender key for %s: %w", jid, err)
+	}
+	cli.initGroupDeviceTracking()
+	cli.groupDevicesLock.Lock()
+	delete(cli.groupDevices, jid.String())
+	cli.groupDevicesLock.Unlock()
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package multidevice
+
+import (
+	"testing"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+)
+
+func jidFor(user string, device byte) waBinary.FullJID {
+	return waBinary.NewADJID(user, 0, device)
+}
+
+func TestDiffGroupDevicesFirstCallReportsEveryoneAdded(t *testing.T) {
+	cli := &Client{}
+	group := waBinary.NewJID("123", waBinary.GroupServer)
+	current := []waBinary.FullJID{jidFor("111", 0), jidFor("222", 0)}
+
+	added, shrunk := cli.diffGroupDevices(group, current)
+	if shrunk {
+		t.Fatalf("first call should never report shrunk")
+	}
+	if len(added) != len(current) {
+		t.Fatalf("expected all %d devices reported added, got %d", len(current), len(added))
+	}
+}
+
+func TestDiffGroupDevicesDetectsAddedAndShrunk(t *testing.T) {
+	cli := &Client{}
+	group := waBinary.NewJID("123", waBinary.GroupServer)
+
+	cli.diffGroupDevices(group, []waBinary.FullJID{jidFor("111", 0), jidFor("222", 0)})
+
+	// 111 left, 333 joined: expect 333 added and shrunk true.
+	added, shrunk := cli.diffGroupDevices(group, []waBinary.FullJID{jidFor("222", 0), jidFor("333", 0)})
+	if !shrunk {
+		t.Fatalf("expected shrunk to be true when a device leaves")
+	}
+	if len(added) != 1 || added[0] != jidFor("333", 0) {
+		t.Fatalf("expected only 333 to be reported added, got %v", added)
+	}
+}
+
+func TestDiffGroupDevicesNoChangeNeitherAddedNorShrunk(t *testing.T) {
+	cli := &Client{}
+	group := waBinary.NewJID("123", waBinary.GroupServer)
+	devices := []waBinary.FullJID{jidFor("111", 0), jidFor("222", 0)}
+
+	cli.diffGroupDevices(group, devices)
+	added, shrunk := cli.diffGroupDevices(group, devices)
+	if shrunk {
+		t.Fatalf("expected shrunk to be false when the device set is unchanged")
+	}
+	if len(added) != 0 {
+		t.Fatalf("expected no devices reported added, got %v", added)
+	}
+}